@@ -1,54 +1,77 @@
-// Fast downloader of OONI reports using the OONI API. Syncs a local directory
+// Fast downloader of OONI reports using the OONI API. Syncs a destination
 // with all reports satisfying a given API query. Only downloads reports that
-// are not already present locally.
+// are not already present there.
 //
 // Example usage:
-// 	ooni-sync -xz -directory reports.tcp_connect.201701 test_name=tcp_connect since=2017-01-01 until=2017-02-02
+//
+//	ooni-sync -output 'file://reports.tcp_connect.201701?compress=xz' test_name=tcp_connect since=2017-01-01 until=2017-02-02
+//
 // This command will create the directory reports.tcp_connect.201701 if it
 // doesn't exist, download all reports satisfying the given query that are not
-// already present in the directory, and compress the downloaded reports with
-// xz.
+// already present there, and compress the downloaded reports with xz.
 //
 // Possible API query parameters:
-// 	test_name=[name] # e.g. web_connectivity, http_host, tcp_connect
-// 	probe_cc=[cc]
-// 	probe_asn=AS[num]
-// 	since=[yyyy-mm-dd]
-// 	until=[yyyy-mm-dd]
 //
-// By default, downloaded reports will be saved into the current directory. Use
-// the -directory option to control the output directory. Use the -xz option to
-// compress the downloaded reports (the .xz extension will be taken into account
-// during later syncs, to avoid downloading the same report again).
+//	test_name=[name] # e.g. web_connectivity, http_host, tcp_connect
+//	probe_cc=[cc]
+//	probe_asn=AS[num]
+//	since=[yyyy-mm-dd]
+//	until=[yyyy-mm-dd]
+//
+// By default, downloaded reports will be saved as uncompressed files in the
+// current directory. Use the -output option to choose a different
+// destination (a local directory, a local tar archive, or an S3-compatible
+// bucket) and compression method; see the sink package for the full syntax.
+// The -directory and -xz options are a shorthand for the common case of
+// -output 'file://DIRECTORY[?compress=xz]'.
+//
+// The program doesn't use checksums or timestamps to decide whether to
+// download a report, only names: it assumes that if the destination already
+// has an entry with the same name as a remote file, the contents are
+// identical. For that reason, the program tries hard not to allow such an
+// entry to exist unless it has the same contents: an interrupted download is
+// kept under a ".part" filename, not its final name, and resumed (with an
+// HTTP Range request) the next time the same report is downloaded. Use the
+// -checksum option to additionally verify each download against the sha256
+// digest given on the index page, when the API provides one, before it is
+// accepted.
+//
+// Use the -progress option to replace the one-line-per-file log with a
+// multi-bar display showing each download worker's current file and speed
+// plus an aggregate completion bar (this has no effect when stdout is not a
+// terminal).
 //
-// The program doesn't use checksums or timestamps for to compare local and
-// remote content, only filenames. It assumes that if there is a local file with
-// the same name as a remote file (perhaps adding a .xz extension), that the
-// contents are identical. For that reason, the program tries hard not allow a
-// local file to exist with the same name as a remote file unless it has the
-// same contents. For example, an interrupted download will be discarded rather
-// than left partially downloaded under its final filename.
+// The program saves its place in the index, as a cursor keyed by the query,
+// to a state file named .ooni-sync.state in the directory given by
+// -directory (the current directory by default), also when -output names a
+// different destination. A later
+// run of ooni-sync with the same query and directory resumes paging from
+// that cursor rather than rescanning the whole index from the start. Use the
+// -full option to ignore any saved cursor and do a full rescan.
+//
+// The downloading and syncing logic lives in the oonisync package
+// (pkg/oonisync), so that other Go programs can embed it directly; this
+// command is a thin wrapper that parses flags, builds an oonisync.Client,
+// and renders its event stream.
 //
 // For documentation on the OONI API, see
 // https://measurements.ooni.torproject.org/api/.
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
+	"log"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
-	"path"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/ooni/ooni-sync/pkg/oonisync"
+	"github.com/ooni/ooni-sync/sink"
 )
 
 func usage() {
@@ -63,68 +86,6 @@ https://measurements.ooni.torproject.org/api/. For example:
 	flag.PrintDefaults()
 }
 
-// https://measurements.ooni.torproject.org/api/
-const ooniAPIURL = "https://measurements.ooni.torproject.org/api/v1/files"
-const ooniAPILimit = 1000
-const numDownloadThreads = 5
-
-// Controlled by the -directory option.
-var outputDirectory = "."
-
-// The -xz option changes these.
-var outputExtension = ""
-var downloadFilter = identityFilter
-
-// Output filter to use when -xz is not in effect (save reports verbatim).
-func identityFilter(w io.WriteCloser) (io.WriteCloser, error) {
-	return w, nil
-}
-
-type xzFilter struct {
-	cmd   *exec.Cmd
-	stdin io.WriteCloser
-}
-
-// Output filter to use when -xz is in effect.
-func newXZFilter(w io.WriteCloser) (io.WriteCloser, error) {
-	var err error
-	xz := &xzFilter{}
-
-	xz.cmd = exec.Command("xz", "-c")
-	xz.cmd.Stdout = w
-	xz.stdin, err = xz.cmd.StdinPipe()
-	if err != nil {
-		return nil, err
-	}
-	err = xz.cmd.Start()
-	if err != nil {
-		return nil, err
-	}
-	return xz, nil
-}
-
-func (xz *xzFilter) Write(p []byte) (int, error) {
-	return xz.stdin.Write(p)
-}
-
-func (xz *xzFilter) Close() error {
-	err := xz.stdin.Close()
-	if err != nil {
-		return err
-	}
-	return xz.cmd.Wait()
-}
-
-// Represents the state of a download attempt. processIndex writes these into a
-// channel and the main goroutine collects them for status updates and cleanup.
-type result struct {
-	URL           string
-	LocalFilename string
-	TmpFilename   string
-	Exists        bool
-	Err           error
-}
-
 // This struct helps serialize the "X/Y" output messages.
 type progressCounter struct {
 	n, total uint
@@ -138,207 +99,32 @@ func (progress *progressCounter) format() string {
 
 var progress progressCounter
 
-type ooniMetadata struct {
-	Count  uint `json:"count"`
-	Offset uint `json:"offset"`
-	Limit  uint `json:"limit"`
-	// `json:"current_page"`
-	// `json:"next_url"`
-	// `json:"pages"`
-}
-
-type ooniResult struct {
-	DownloadURL string `json:"download_url"`
-	Index       uint   `json:"index"`
-	// `json:"probe_asn"`
-	// `json:"probe_cc"`
-	// `json:"test_start_time"`
-}
-
-type ooniIndexPage struct {
-	Metadata ooniMetadata `json:"metadata"`
-	Results  []ooniResult `json:"results"`
-}
-
-// Download the contents of a URL and copy them into w.
-func downloadToWriteCloser(urlString string, w io.WriteCloser) (err error) {
-	var resp *http.Response
-	resp, err = http.Get(urlString)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err2 := resp.Body.Close()
-		if err == nil {
-			err = err2
-		}
-	}()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("got %q", resp.Status)
-	}
-
-	_, err = io.Copy(w, resp.Body)
-	return err
-}
-
-// Download a URL to a temporary file. Writes the name of the temporary file to
-// tmpFilenameChan before doing anything with it. Runs the downloaded contents
-// through the an io.WriteCloser produced by calling downloadFilter on the
-// temporary file.
-func downloadToTmpFile(urlString string, tmpFilenameChan chan<- string) (string, error) {
-	tmpfile, err := ioutil.TempFile(outputDirectory, "ooni-sync.tmp.")
-	if err != nil {
-		return "", err
-	}
-	// Tell the main goroutine thread to clean up this temporary file.
-	tmpFilenameChan <- tmpfile.Name()
-
-	// Optionally compress.
-	w, err := downloadFilter(tmpfile)
-	if err != nil {
-		return "", err
-	}
-
-	err = downloadToWriteCloser(urlString, w)
-	err2 := w.Close()
-	if err == nil {
-		err = err2
-	}
-
-	return tmpfile.Name(), err
-}
-
-// Check if a URL needs to be downloaded by checking for a matching local file,
-// and download it if so.
-func maybeDownload(urlString string, tmpFilenameChan chan<- string) *result {
-	r := &result{}
-	r.URL = urlString
-
-	u, err := url.Parse(r.URL)
-	if err != nil {
-		r.Err = err
-		return r
-	}
-	r.LocalFilename = filepath.Join(outputDirectory, path.Base(u.Path)) + outputExtension
-
-	_, err = os.Stat(r.LocalFilename)
-	if err == nil {
-		r.Exists = true
-		return r
-	} else if !os.IsNotExist(err) {
-		r.Err = err
-		return r
-	}
-
-	r.TmpFilename, r.Err = downloadToTmpFile(r.URL, tmpFilenameChan)
-	return r
+func logOK(name string) {
+	progress.mutex.Lock()
+	progress.n += 1
+	fmt.Printf("%s ok: %s\n", progress.format(), name)
+	progress.mutex.Unlock()
 }
 
-func downloadFromChan(downloadURLChan <-chan string, resultChan chan<- *result, tmpFilenameChan chan<- string) {
-	for downloadURL := range downloadURLChan {
-		resultChan <- maybeDownload(downloadURL, tmpFilenameChan)
-	}
+func logExists(name string) {
+	progress.mutex.Lock()
+	progress.n += 1
+	fmt.Printf("%s exists: %s\n", progress.format(), name)
+	progress.mutex.Unlock()
 }
 
-func fetchIndexPage(baseQuery url.Values, limit, offset uint) (*ooniIndexPage, error) {
-	u, err := url.Parse(ooniAPIURL)
-	if err != nil {
-		return nil, err
-	}
-
-	// Copy the requested query values (e.g. "test_name").
-	query := u.Query()
-	for k, v := range baseQuery {
-		query[k] = v
-	}
-	// Set query values "order", "limit", and "offset".
-	// We order by test_start_time and start with the oldest reports, so
-	// that any reports that are published while the program is running will
-	// be more likely to be appended to the final index page, and not throw
-	// off the offsets for index pages already downloaded.
-	// It would be better to order by index rather than test_start_time,
-	// because index is increasing over time while newly published reports
-	// may have a test_start_time in the past.
-	query.Set("order", "asc")
-	query.Set("limit", fmt.Sprintf("%d", limit))
-	query.Set("offset", fmt.Sprintf("%d", offset))
-	u.RawQuery = query.Encode()
-
-	fmt.Printf("Index: %s\n", u.String())
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		err2 := resp.Body.Close()
-		if err == nil {
-			err = err2
-		}
-	}()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("got %q", resp.Status)
-	}
-
-	var indexPage ooniIndexPage
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&indexPage)
-	if err != nil {
-		return nil, err
-	}
-	if decoder.More() {
-		return &indexPage, fmt.Errorf("expected only one JSON value")
-	}
-
-	return &indexPage, nil
+func logFiltered(name string) {
+	progress.mutex.Lock()
+	progress.n += 1
+	fmt.Printf("%s filtered: %s\n", progress.format(), name)
+	progress.mutex.Unlock()
 }
 
-func processIndex(query url.Values, downloadURLChan chan<- string) error {
-	var offset uint = 0
-	for {
-		indexPage, err := fetchIndexPage(query, ooniAPILimit, offset)
-		if err != nil {
-			return err
-		}
-
-		// Sanity checks.
-		if indexPage.Metadata.Limit != ooniAPILimit {
-			return fmt.Errorf("expected limit=%d, got limit=%d", ooniAPILimit, indexPage.Metadata.Limit)
-		}
-		if offset != indexPage.Metadata.Offset {
-			return fmt.Errorf("expected offset=%d, got offset=%d", offset, indexPage.Metadata.Offset)
-		}
-
-		numResults := uint(len(indexPage.Results))
-
-		// Require at least one result so we're guaranteed to make
-		// progress on each iteration. The only time zero results are
-		// allowed is when indexPage.Metadata.Count == 0.
-		if indexPage.Metadata.Count > 0 && numResults == 0 {
-			return fmt.Errorf("zero results")
-		}
-
-		progress.mutex.Lock()
-		progress.total = indexPage.Metadata.Count
-		progress.mutex.Unlock()
-
-		offset += uint(len(indexPage.Results))
-
-		if offset > indexPage.Metadata.Count {
-			return fmt.Errorf("offset exceeds count: %d > %d", offset, indexPage.Metadata.Count)
-		}
-
-		for _, result := range indexPage.Results {
-			downloadURLChan <- result.DownloadURL
-		}
-
-		if offset == indexPage.Metadata.Count {
-			// All done.
-			break
-		}
-		// Otherwise continue looping.
-	}
-
-	return nil
+func logError(downloadURL string, err error) {
+	progress.mutex.Lock()
+	progress.n += 1
+	fmt.Printf("%s error: %s: %s\n", progress.format(), downloadURL, err)
+	progress.mutex.Unlock()
 }
 
 // Parse a sequence of "key=value" strings into a url.Values.
@@ -354,71 +140,56 @@ func parseArgsToQuery(args []string) (url.Values, error) {
 	return query, nil
 }
 
-// Fix up the input query string to match the formats the server expects.
-// Uppercases the values of probe_cc and adds a missing "AS" to the values of
-// probe_asn.
-func canonicalizeQuery(query url.Values) url.Values {
-	canon := url.Values{}
-	for key, values := range query {
-		if key == "probe_cc" {
-			// Country codes have to be uppercase.
-			for _, v := range values {
-				canon.Add(key, strings.ToUpper(v))
-			}
-		} else if key == "probe_asn" {
-			for _, v := range values {
-				// If it's just a number, add an "AS" prefix.
-				if _, err := strconv.ParseUint(v, 10, 32); err == nil {
-					v = "AS" + v
-				}
-				v = strings.ToUpper(v)
-				canon.Add(key, v)
-			}
-		} else {
-			canon[key] = values
-		}
-	}
-	return canon
-}
-
-func logOK(localFilename string) {
-	progress.mutex.Lock()
-	progress.n += 1
-	fmt.Printf("%s ok: %s\n", progress.format(), localFilename)
-	progress.mutex.Unlock()
-}
-
-func logExists(localFilename string) {
-	progress.mutex.Lock()
-	progress.n += 1
-	fmt.Printf("%s exists: %s\n", progress.format(), localFilename)
-	progress.mutex.Unlock()
-}
-
-func logError(downloadURL string, err error) {
-	progress.mutex.Lock()
-	progress.n += 1
-	fmt.Printf("%s error: %s: %s\n", progress.format(), downloadURL, err)
-	progress.mutex.Unlock()
-}
-
 func main() {
 	var xz bool
+	var outputSpec string
+	var verifyChecksum bool
+	var parallelism int
+	var useProgress bool
+	var full bool
+	var directory = "."
 
 	flag.Usage = usage
-	flag.StringVar(&outputDirectory, "directory", outputDirectory, "directory in which to save results")
-	flag.BoolVar(&xz, "xz", xz, "compress downloads with xz")
+	flag.StringVar(&directory, "directory", directory, "directory in which to save results and the sync cursor (ignored for -output if given)")
+	flag.BoolVar(&xz, "xz", xz, "compress downloads with xz (ignored if -output is given)")
+	flag.StringVar(&outputSpec, "output", "", "destination for downloaded reports, e.g. 'tar://archives?compress=zstd' or 's3://bucket/prefix' (default: a file:// sink built from -directory and -xz)")
+	flag.BoolVar(&verifyChecksum, "checksum", verifyChecksum, "verify downloads against the index page's sha256 digest, when present")
+	flag.IntVar(&parallelism, "parallel", oonisync.DefaultParallelism, "number of concurrent downloads")
+	flag.BoolVar(&useProgress, "progress", useProgress, "show a multi-bar progress display instead of one line per file (ignored if stdout is not a terminal)")
+	flag.BoolVar(&full, "full", full, "ignore any saved cursor and page through the whole index from the start")
 	flag.Parse()
 
-	err := os.MkdirAll(outputDirectory, 0755)
-	if err != nil {
+	// Normalize here, rather than leaving it to oonisync.Client, so that
+	// newReporter below builds exactly as many bars as there will be
+	// workers; -parallel 0 would otherwise build a reporter with no bars
+	// for the DefaultParallelism workers the client actually starts, and a
+	// negative value would make newBarReporter panic.
+	if parallelism <= 0 {
+		parallelism = oonisync.DefaultParallelism
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
 
-	if xz {
-		outputExtension = ".xz"
-		downloadFilter = newXZFilter
+	var destSink sink.Sink
+	var err error
+	if outputSpec != "" {
+		destSink, err = sink.Parse(outputSpec)
+	} else {
+		compress := ""
+		if xz {
+			compress = "xz"
+		}
+		destSink = &sink.FileSink{Directory: directory, Compress: compress}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	if closer, ok := destSink.(io.Closer); ok {
+		defer closer.Close()
 	}
 
 	query, err := parseArgsToQuery(flag.Args())
@@ -426,93 +197,55 @@ func main() {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
-	query = canonicalizeQuery(query)
-
-	// The overall structure: processIndex downloads index pages for the
-	// given query and feeds the resulting report URLs into downloadURLChan.
-	// downloadFromChan reads from downloadURLChan, checks for each URL
-	// whether a copy already exists locally, and downloads it if not,
-	// writing the result of the download attempt to resultChan and logging
-	// any temporary files it creates to tmpFilenameChan. The loop in main
-	// reads from resultChan and tmpFilenameChan, renaming temporary files
-	// to their final filenames as necessary and keeping track of temporary
-	// files that have not been renamed (so they can be deleted in case the
-	// program is interrupted).
 
-	downloadURLChan := make(chan string, ooniAPILimit)
-	tmpFilenameChan := make(chan string)
-	resultChan := make(chan *result)
+	// ctx is canceled on SIGINT, so that in-flight HTTP requests abort
+	// promptly instead of running to completion.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	var signalFlag bool
 	go func() {
-		// Download indexes and write the URLs they contain to
-		// downloadURLChan.
-		err = processIndex(query, downloadURLChan)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %s\n", err)
-			os.Exit(1)
+		if _, ok := <-sigChan; ok {
+			signalFlag = true
+			cancel()
 		}
-		close(downloadURLChan)
-	}()
-	// Start concurrent downloader threads.
-	var wg sync.WaitGroup
-	wg.Add(numDownloadThreads)
-	for i := 0; i < numDownloadThreads; i++ {
-		go func() {
-			downloadFromChan(downloadURLChan, resultChan, tmpFilenameChan)
-			wg.Done()
-		}()
-	}
-	go func() {
-		wg.Wait()
-		close(resultChan)
 	}()
 
-	// Keep track of temporary files we need to delete at the end.
-	tmpFilenames := make(map[string]struct{})
-	// Things we need to know for the final exit code.
-	var numErrors uint
-	var signalFlag bool
-
-	// Handle SIGINT for cleanup purposes (deleting temporary files).
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, os.Interrupt)
+	appReporter := newReporter(useProgress, parallelism, 0)
+	defer appReporter.stop()
+
+	client := &oonisync.Client{
+		Sink:           destSink,
+		Parallelism:    parallelism,
+		VerifyChecksum: verifyChecksum,
+		StateDir:       directory,
+		Full:           full,
+		PartDir:        directory,
+		Logger:         log.New(os.Stdout, "", 0),
+		Progress:       appReporter,
+	}
 
-loop:
-	for {
-		select {
-		case tmpFilename := <-tmpFilenameChan:
-			tmpFilenames[tmpFilename] = struct{}{}
-		case r, ok := <-resultChan:
-			if !ok {
-				break loop
-			}
-			if r.Err != nil {
-				logError(r.URL, r.Err)
-				numErrors += 1
-			} else if r.Exists {
-				logExists(r.LocalFilename)
-			} else {
-				err := os.Rename(r.TmpFilename, r.LocalFilename)
-				if err != nil {
-					logError(r.URL, err)
-					numErrors += 1
-				} else {
-					// This temporary file has been handled;
-					// stop tracking it.
-					delete(tmpFilenames, r.TmpFilename)
-					logOK(r.LocalFilename)
-				}
-			}
-		case <-sigChan:
-			signalFlag = true
-			break loop
-		}
+	events, err := client.Sync(ctx, query)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
 	}
 
-	// Either resultChan was closed or we received a signal. Clean up.
-	for tmpFilename := range tmpFilenames {
-		err := os.Remove(tmpFilename)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "cannot delete temporary: %s", err)
+	var numErrors uint
+	for ev := range events {
+		switch ev.Type {
+		case oonisync.IndexPageFetched:
+			progress.mutex.Lock()
+			progress.total = ev.Count
+			progress.mutex.Unlock()
+			appReporter.SetTotal(ev.Count)
+		case oonisync.ReportDownloaded:
+			appReporter.downloaded(ev.Worker, ev.Name)
+		case oonisync.ReportSkipped:
+			appReporter.skipped(ev.Worker, ev.Name, ev.Reason)
+		case oonisync.ReportFailed:
+			appReporter.errored(ev.Worker, ev.URL, ev.Err)
 			numErrors += 1
 		}
 	}
@@ -0,0 +1,106 @@
+package oonisync
+
+import "sync"
+
+// cursorTracker persists the sync cursor once every report queued for
+// download from an index page has reached a terminal outcome (downloaded,
+// skipped, or failed), rather than as soon as the page has been paged
+// through. That keeps the cursor saved on disk from ever advancing past a
+// report that a run was interrupted, or failed, before confirming; a later
+// run resumes from there and, via Sink.Exists, re-skips only what was
+// actually downloaded.
+//
+// Pages are resolved in the order addPage registered them. Once a page is
+// found to contain a failed report, its cursor (and every later page's) is
+// never persisted, so a run with a transient download failure doesn't keep
+// advancing the saved cursor past it.
+type cursorTracker struct {
+	persist bool
+	path    string
+	logf    func(format string, args ...interface{})
+
+	mu      sync.Mutex
+	pending []*trackedPage
+	stopped bool
+}
+
+// trackedPage is one index page's resulting cursor state, waiting on the
+// outcome of every report it queued for download before that state can be
+// persisted.
+type trackedPage struct {
+	state     syncState
+	remaining map[string]bool
+	failed    bool
+}
+
+// newCursorTracker returns a cursorTracker that persists cursors to path, or
+// that discards them (but still tracks completion bookkeeping, for a
+// uniform code path in processIndex) if persist is false.
+func newCursorTracker(persist bool, path string, logf func(format string, args ...interface{})) *cursorTracker {
+	return &cursorTracker{persist: persist, path: path, logf: logf}
+}
+
+// addPage registers state, the cursor as of the end of a page, to be
+// persisted once every URL in urls has been observed (via observe) reaching
+// a terminal outcome. It's called from processIndex's goroutine, in the
+// order pages are paged through. A page with no URLs (e.g. one entirely
+// rejected by Client.Filter) is eligible to persist immediately.
+func (t *cursorTracker) addPage(state syncState, urls []string) {
+	page := &trackedPage{state: state, remaining: make(map[string]bool, len(urls))}
+	for _, u := range urls {
+		page.remaining[u] = true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, page)
+	t.resolveLocked()
+}
+
+// observe records the terminal outcome of the download worker Event ev,
+// persisting the cursor past whichever pages at the front of the queue are
+// now fully resolved. Events other than ReportDownloaded, ReportSkipped, and
+// ReportFailed (which don't correspond to a queued download) are ignored.
+func (t *cursorTracker) observe(ev Event) {
+	if ev.Type != ReportDownloaded && ev.Type != ReportSkipped && ev.Type != ReportFailed {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, page := range t.pending {
+		if _, ok := page.remaining[ev.URL]; !ok {
+			continue
+		}
+		delete(page.remaining, ev.URL)
+		if ev.Type == ReportFailed {
+			page.failed = true
+		}
+		break
+	}
+	t.resolveLocked()
+}
+
+// resolveLocked persists and dequeues pages, in order, for as long as the
+// front of the queue has nothing left outstanding. Callers must hold t.mu.
+func (t *cursorTracker) resolveLocked() {
+	for len(t.pending) > 0 && len(t.pending[0].remaining) == 0 {
+		page := t.pending[0]
+		t.pending = t.pending[1:]
+
+		if t.stopped {
+			continue
+		}
+		if page.failed {
+			t.stopped = true
+			continue
+		}
+		if !t.persist {
+			continue
+		}
+		if err := saveState(t.path, &page.state); err != nil {
+			t.logf("error saving sync cursor: %s", err)
+			t.stopped = true
+		}
+	}
+}
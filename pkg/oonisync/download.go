@@ -0,0 +1,323 @@
+package oonisync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ooni/ooni-sync/xfer"
+)
+
+// downloadJob represents a report to be downloaded, as extracted from an
+// index page. processIndex writes these into downloadURLChan for the
+// download workers to consume.
+type downloadJob struct {
+	URL string
+	// SHA256 is the expected digest of the downloaded content, or "" if
+	// the index page didn't provide one.
+	SHA256 string
+}
+
+// reportName derives the bare name passed to the sink from a report's
+// download URL.
+func reportName(downloadURL string) string {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return downloadURL
+	}
+	return path.Base(u.Path)
+}
+
+// countingReader wraps an io.Reader, calling advance with the number of
+// bytes read on each call to Read. It's used to drive a worker's Progress
+// calls from inside downloadToWriteCloser without that function needing to
+// know about the UI layer.
+type countingReader struct {
+	r       io.Reader
+	advance func(n int64)
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.advance(int64(n))
+	}
+	return n, err
+}
+
+func noopAdvance(int64) {}
+
+// downloadToWriteCloser downloads the contents of a URL into w, resuming a
+// partial download already present in w by issuing a Range request for the
+// bytes past the current end of w. The server is expected to reply with 206
+// Partial Content; if it instead replies with 200 OK (meaning it doesn't
+// support Range, or the previous partial content is no longer valid), w is
+// truncated and the download restarts from the beginning. A 416 Range Not
+// Satisfiable means w already has everything the server has to offer, which
+// happens when a previous attempt finished the download but failed at some
+// later step (e.g. handing it off to the sink); that's treated as success,
+// not an error.
+//
+// The returned error is classified with xfer.Permanent for status codes that
+// retrying cannot fix (404 and other 4xx besides 408, 416, and 429), so that
+// the caller's xfer.Manager knows not to retry them.
+//
+// Progress (including bytes already present in w from a previous attempt) is
+// reported to c.Progress, if set, under worker's bar, labeled with name.
+func (c *Client) downloadToWriteCloser(ctx context.Context, urlString string, w *os.File, worker int, name string) (err error) {
+	offset, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", urlString, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err2 := resp.Body.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Server honored our Range request; append what follows.
+	case http.StatusOK:
+		// Server ignored our Range request and is sending the whole
+		// file from the start. Discard what we had and start over.
+		if err := w.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := w.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// We asked for the bytes past what w already has, and the
+		// server says there aren't any: w already holds the whole
+		// file, most likely because a previous attempt finished the
+		// download but failed before the part file could be removed
+		// (e.g. the sink write that follows it failed). Treat this as
+		// done rather than an error, so retrying the sink write isn't
+		// defeated by a spurious permanent failure here.
+		return nil
+	default:
+		return classifyHTTPError(resp)
+	}
+
+	advance := noopAdvance
+	if c.Progress != nil {
+		var total int64
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		c.Progress.Start(worker, name, total)
+		c.Progress.Advance(worker, offset)
+		advance = func(n int64) { c.Progress.Advance(worker, n) }
+	}
+
+	body := &countingReader{r: resp.Body, advance: advance}
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// classifyHTTPError builds an error from a non-2xx response, wrapping it
+// with xfer.Permanent unless the status indicates a transient condition (a
+// 5xx server error, a 408 Request Timeout, or a 429 Too Many Requests). A 429
+// response carrying a Retry-After header, which the OONI API may send under
+// heavy load, is wrapped with xfer.RetryAfter instead, so the caller's
+// xfer.Manager waits the requested delay rather than its own backoff.
+func classifyHTTPError(resp *http.Response) error {
+	err := fmt.Errorf("got %q", resp.Status)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return xfer.RetryAfter(err, delay)
+		}
+		return err
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout {
+		return err
+	}
+	return xfer.Permanent(err)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which per RFC
+// 7231 §7.1.3 is either a number of seconds or an HTTP date, returning false
+// if v is empty or doesn't match either form.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// downloadToPartFile downloads a URL into a ".part" file at partFilename,
+// resuming from whatever bytes of it (if any) are already present from a
+// previous, interrupted attempt.
+func (c *Client) downloadToPartFile(ctx context.Context, urlString, partFilename string, worker int, name string) (err error) {
+	partFile, err := os.OpenFile(partFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err2 := partFile.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+
+	return c.downloadToWriteCloser(ctx, urlString, partFile, worker, name)
+}
+
+// downloadToSink downloads a URL into the local ".part" file at
+// partFilename, resuming any previous partial download of the same report,
+// then (if c.VerifyChecksum is set) verifies it against job.SHA256 and hands
+// its complete content to c.Sink under name. The part file is local scratch
+// space regardless of which sink is in use; it's removed once its content
+// has been fully consumed into the sink.
+func (c *Client) downloadToSink(ctx context.Context, job downloadJob, partFilename string, worker int, name string) (err error) {
+	err = c.downloadToPartFile(ctx, job.URL, partFilename, worker, name)
+	if err != nil {
+		return err
+	}
+
+	if c.VerifyChecksum && job.SHA256 != "" {
+		ok, err := fileMatchesSHA256(partFilename, job.SHA256)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			os.Remove(partFilename)
+			return fmt.Errorf("checksum mismatch for %s", job.URL)
+		}
+	}
+
+	partFile, err := os.Open(partFilename)
+	if err != nil {
+		return err
+	}
+	defer partFile.Close()
+
+	w, err := c.Sink.Open(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, partFile)
+	err2 := w.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	// The part file's content has been fully consumed into the sink; it
+	// no longer serves as resume state.
+	os.Remove(partFilename)
+
+	return nil
+}
+
+// fileMatchesSHA256 reports whether the contents of the file at path hash to
+// the given hex-encoded SHA256 digest, computing the hash by streaming the
+// file rather than reading it into memory.
+func fileMatchesSHA256(path string, digest string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(digest), nil
+}
+
+// maybeDownload checks if a URL needs to be downloaded by checking whether
+// c.Sink already has a matching entry, and downloads it if not, retrying
+// transient failures through manager and reporting progress under worker's
+// bar. partDir is the local directory in which to keep the ".part" file
+// while the download is in progress.
+func (c *Client) maybeDownload(ctx context.Context, manager *xfer.Manager, partDir string, job downloadJob, worker int) Event {
+	name := reportName(job.URL)
+	ev := Event{Name: name, URL: job.URL, Worker: worker}
+	partFilename := filepath.Join(partDir, name) + ".part"
+
+	exists, err := c.Sink.Exists(name)
+	if err != nil {
+		ev.Type = ReportFailed
+		ev.Err = err
+		return ev
+	}
+	if exists {
+		ev.Type = ReportSkipped
+		ev.Reason = "exists"
+		return ev
+	}
+
+	if err := manager.Do(ctx, job.URL, func(ctx context.Context) error {
+		return c.downloadToSink(ctx, job, partFilename, worker, name)
+	}); err != nil {
+		ev.Type = ReportFailed
+		ev.Err = err
+		return ev
+	}
+	ev.Type = ReportDownloaded
+	return ev
+}
+
+// downloadFromChan is run by each of a Sync call's worker goroutines,
+// identified by worker (used to pick its Progress bar, if any). It reads
+// jobs from downloadURLChan, maybe downloading each one, until ctx is
+// canceled or downloadURLChan is closed and drained.
+func (c *Client) downloadFromChan(ctx context.Context, manager *xfer.Manager, partDir string, downloadURLChan <-chan downloadJob, eventChan chan<- Event, worker int) {
+	for {
+		select {
+		case job, ok := <-downloadURLChan:
+			if !ok {
+				return
+			}
+			select {
+			case eventChan <- c.maybeDownload(ctx, manager, partDir, job, worker):
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package oonisync
+
+// EventType identifies what kind of occurrence an Event describes.
+type EventType int
+
+const (
+	// ReportDownloaded indicates that a report was successfully
+	// downloaded (or was already fully downloaded from a previous,
+	// interrupted attempt) and written to the sink.
+	ReportDownloaded EventType = iota
+	// ReportSkipped indicates that a report was not downloaded, either
+	// because it already existed in the sink or because Client.Filter
+	// rejected it; see Event.Reason.
+	ReportSkipped
+	// ReportFailed indicates that downloading a report failed; see
+	// Event.Err.
+	ReportFailed
+	// IndexPageFetched indicates that a page of the index was fetched;
+	// see Event.Count.
+	IndexPageFetched
+)
+
+// NoWorker is the Event.Worker value for a ReportSkipped event that doesn't
+// originate from any download worker, such as one reporting a report
+// rejected by Client.Filter while paging through the index, so that a
+// caller rendering per-worker progress doesn't mistake it for worker 0.
+const NoWorker = -1
+
+func (t EventType) String() string {
+	switch t {
+	case ReportDownloaded:
+		return "ReportDownloaded"
+	case ReportSkipped:
+		return "ReportSkipped"
+	case ReportFailed:
+		return "ReportFailed"
+	case IndexPageFetched:
+		return "IndexPageFetched"
+	default:
+		return "EventType(?)"
+	}
+}
+
+// Event describes one occurrence during a Sync call. Events are sent to the
+// channel Sync returns from multiple goroutines (one per download worker,
+// plus the goroutine paging through the index), in no particular overall
+// order; events for a single report, however, are never sent concurrently
+// with each other.
+type Event struct {
+	Type EventType
+
+	// Name is the bare report name passed to the sink. Set for
+	// ReportDownloaded, ReportSkipped, and ReportFailed.
+	Name string
+	// URL is the report's download URL. Set for ReportDownloaded,
+	// ReportSkipped, and ReportFailed.
+	URL string
+	// Reason explains a ReportSkipped event: "exists" if the sink
+	// already had a matching entry, or "filtered" if Client.Filter
+	// rejected the report.
+	Reason string
+	// Err is the error that caused a ReportFailed event.
+	Err error
+	// Worker identifies which download worker produced a
+	// ReportDownloaded, ReportSkipped, or ReportFailed event, for
+	// attributing it to the same worker as the Progress calls that
+	// preceded it. It's NoWorker for a ReportSkipped event with Reason
+	// "filtered", which originates from paging through the index rather
+	// than from any download worker.
+	Worker int
+
+	// Count is the total number of reports matching the query, from the
+	// fetched index page's metadata. Set for IndexPageFetched events.
+	Count uint
+}
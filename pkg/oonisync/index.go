@@ -0,0 +1,272 @@
+package oonisync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type ooniMetadata struct {
+	Count  uint `json:"count"`
+	Offset uint `json:"offset"`
+	Limit  uint `json:"limit"`
+	// `json:"current_page"`
+	// `json:"next_url"`
+	// `json:"pages"`
+}
+
+type ooniIndexPage struct {
+	Metadata ooniMetadata `json:"metadata"`
+	Results  []Report     `json:"results"`
+}
+
+// canonicalizeQuery fixes up the input query string to match the formats the
+// server expects: uppercases the values of probe_cc and adds a missing "AS"
+// to the values of probe_asn.
+func canonicalizeQuery(query url.Values) url.Values {
+	canon := url.Values{}
+	for key, values := range query {
+		if key == "probe_cc" {
+			// Country codes have to be uppercase.
+			for _, v := range values {
+				canon.Add(key, strings.ToUpper(v))
+			}
+		} else if key == "probe_asn" {
+			for _, v := range values {
+				// If it's just a number, add an "AS" prefix.
+				if _, err := strconv.ParseUint(v, 10, 32); err == nil {
+					v = "AS" + v
+				}
+				v = strings.ToUpper(v)
+				canon.Add(key, v)
+			}
+		} else {
+			canon[key] = values
+		}
+	}
+	return canon
+}
+
+// fetchedIndexPage is the result of fetching one page of the index: either a
+// decoded page of results, or, when cond is given and the server confirms
+// that the newest page hasn't changed since the previous run, NotModified
+// set with no page.
+type fetchedIndexPage struct {
+	Page         *ooniIndexPage
+	ETag         string
+	LastModified string
+	NotModified  bool
+}
+
+// fetchIndexPage fetches one page of the index. If cond is non-nil, it's
+// sent as conditional request headers (If-None-Match, If-Modified-Since),
+// carrying the ETag and Last-Modified of the last page fetched on a previous
+// run (the page ending at the offset this run resumes from); a 304 Not
+// Modified response is taken to mean nothing has changed since,
+// short-circuiting a rescan.
+func (c *Client) fetchIndexPage(ctx context.Context, baseQuery url.Values, limit, offset uint, cond *syncState) (*fetchedIndexPage, error) {
+	u, err := url.Parse(ooniAPIURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the requested query values (e.g. "test_name").
+	query := u.Query()
+	for k, v := range baseQuery {
+		query[k] = v
+	}
+	// Set query values "order", "limit", and "offset".
+	// We order by test_start_time and start with the oldest reports, so
+	// that any reports that are published while the program is running will
+	// be more likely to be appended to the final index page, and not throw
+	// off the offsets for index pages already downloaded.
+	// It would be better to order by index rather than test_start_time,
+	// because index is increasing over time while newly published reports
+	// may have a test_start_time in the past.
+	query.Set("order", "asc")
+	query.Set("limit", fmt.Sprintf("%d", limit))
+	query.Set("offset", fmt.Sprintf("%d", offset))
+	u.RawQuery = query.Encode()
+
+	c.logf("Index: %s", u.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cond != nil {
+		if cond.ETag != "" {
+			req.Header.Set("If-None-Match", cond.ETag)
+		}
+		if cond.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cond.LastModified)
+		}
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err2 := resp.Body.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+	if resp.StatusCode == http.StatusNotModified {
+		return &fetchedIndexPage{NotModified: true}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, classifyHTTPError(resp)
+	}
+
+	var indexPage ooniIndexPage
+	decoder := json.NewDecoder(resp.Body)
+	err = decoder.Decode(&indexPage)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("expected only one JSON value")
+	}
+
+	return &fetchedIndexPage{
+		Page:         &indexPage,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// processIndex pages through the index for query, feeding the reports it
+// finds into downloadURLChan and sending IndexPageFetched and ReportSkipped
+// (for reports rejected by Filter) events to eventChan. If c.StateDir is
+// empty, it always does a full rescan from offset 0. Otherwise, unless
+// c.Full is true, it resumes from the cursor previously saved at statePath
+// (if any) rather than starting over, and sends a conditional request for
+// the first page it fetches so that a run with nothing new to sync can
+// avoid paging through the index at all.
+//
+// The cursor for a page isn't persisted as soon as it's paged through;
+// instead, it's registered with tracker and only actually written once every
+// report the page queued for download has been confirmed downloaded or
+// skipped (see cursorTracker), so an interrupted or partially-failed run
+// doesn't leave the saved cursor past reports it never confirmed.
+func (c *Client) processIndex(ctx context.Context, query url.Values, downloadURLChan chan<- downloadJob, eventChan chan<- Event, statePath string, tracker *cursorTracker) error {
+	hash := queryHash(query)
+	persistState := c.StateDir != ""
+
+	var cursor *syncState
+	if persistState && !c.Full {
+		var err error
+		cursor, err = loadState(statePath, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	state := &syncState{QueryHash: hash}
+	var offset uint
+	if cursor != nil {
+		offset = cursor.Offset
+		state.Offset = cursor.Offset
+		state.LastIndex = cursor.LastIndex
+	}
+
+	firstFetch := true
+	for {
+		var cond *syncState
+		if firstFetch {
+			cond = cursor
+		}
+		firstFetch = false
+
+		fetched, err := c.fetchIndexPage(ctx, query, ooniAPILimit, offset, cond)
+		if err != nil {
+			return err
+		}
+		if fetched.NotModified {
+			// The page we would have resumed from hasn't changed
+			// since the last run, so there's nothing new to sync.
+			break
+		}
+		indexPage := fetched.Page
+
+		// Sanity checks.
+		if indexPage.Metadata.Limit != ooniAPILimit {
+			return fmt.Errorf("expected limit=%d, got limit=%d", ooniAPILimit, indexPage.Metadata.Limit)
+		}
+		if offset != indexPage.Metadata.Offset {
+			return fmt.Errorf("expected offset=%d, got offset=%d", offset, indexPage.Metadata.Offset)
+		}
+
+		numResults := uint(len(indexPage.Results))
+
+		// Require at least one result so we're guaranteed to make
+		// progress on each iteration. Zero results are also allowed
+		// when indexPage.Metadata.Count == 0, or when we're resuming
+		// from a cursor already at the end and nothing new has been
+		// published since the last run; either way, the offset ==
+		// indexPage.Metadata.Count check below ends the loop.
+		if numResults == 0 && indexPage.Metadata.Count > 0 && offset != indexPage.Metadata.Count {
+			return fmt.Errorf("zero results")
+		}
+
+		select {
+		case eventChan <- (Event{Type: IndexPageFetched, Count: indexPage.Metadata.Count}):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		state.ETag = fetched.ETag
+		state.LastModified = fetched.LastModified
+
+		// If every result in this page is one we already processed on
+		// a previous run, assume (per the ordering caveat above, this
+		// is a heuristic, not a guarantee) that there's nothing new
+		// beyond it either, and stop paging.
+		reachedKnown := numResults > 0
+		var queuedURLs []string
+		for _, report := range indexPage.Results {
+			if report.Index > state.LastIndex {
+				reachedKnown = false
+				state.LastIndex = report.Index
+			}
+
+			if c.Filter != nil && !c.Filter(report) {
+				select {
+				case eventChan <- (Event{Type: ReportSkipped, Name: reportName(report.DownloadURL), URL: report.DownloadURL, Reason: "filtered", Worker: NoWorker}):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+
+			select {
+			case downloadURLChan <- downloadJob{URL: report.DownloadURL, SHA256: report.SHA256}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			queuedURLs = append(queuedURLs, report.DownloadURL)
+		}
+
+		offset += numResults
+		state.Offset = offset
+		tracker.addPage(*state, queuedURLs)
+
+		if offset > indexPage.Metadata.Count {
+			return fmt.Errorf("offset exceeds count: %d > %d", offset, indexPage.Metadata.Count)
+		}
+		if offset == indexPage.Metadata.Count {
+			// All done.
+			break
+		}
+		if reachedKnown {
+			break
+		}
+		// Otherwise continue looping.
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+// Package oonisync implements the logic behind the ooni-sync command:
+// paging through the OONI measurements index for a given API query and
+// downloading the reports it lists into a sink.Sink, resuming interrupted
+// and incremental syncs. It exists so that other Go programs can embed
+// report syncing directly instead of shelling out to the ooni-sync binary.
+package oonisync
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/ooni/ooni-sync/sink"
+)
+
+// https://measurements.ooni.torproject.org/api/
+const ooniAPIURL = "https://measurements.ooni.torproject.org/api/v1/files"
+const ooniAPILimit = 1000
+
+// DefaultParallelism is the number of concurrent downloads used by a Client
+// whose Parallelism field is 0.
+const DefaultParallelism = 5
+
+// Client syncs reports from the OONI measurements API into a sink.Sink.
+// Its zero value is not ready to use: Sink must be set.
+type Client struct {
+	// HTTPClient is used for all requests to the OONI API and for
+	// downloading report content. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Sink is where downloaded report content is stored.
+	Sink sink.Sink
+
+	// Parallelism is the number of concurrent downloads. If 0,
+	// DefaultParallelism is used.
+	Parallelism int
+
+	// VerifyChecksum, if true, verifies each download against the
+	// sha256 digest given on the index page, when the API provides one.
+	VerifyChecksum bool
+
+	// Filter, if non-nil, is called for each report found in the index,
+	// before it is queued for download. Reports for which it returns
+	// false are skipped (reported as a ReportSkipped event with Reason
+	// "filtered") rather than downloaded. This lets a caller drop
+	// reports that can't be expressed in the API query itself, such as
+	// ones above a certain size.
+	Filter func(Report) bool
+
+	// StateDir, if non-empty, is the directory holding the sync cursor
+	// file that lets a later Sync call resume paging through the index
+	// instead of starting over at the beginning. If empty, every Sync
+	// call does a full rescan, as if Full were true.
+	StateDir string
+
+	// Full, if true, ignores any saved cursor in StateDir and pages
+	// through the whole index from the start.
+	Full bool
+
+	// PartDir is the local directory in which to keep a report's ".part"
+	// file while its download is in progress (see the package doc for
+	// ooni-sync's resumable-download scheme). If empty, "." is used.
+	// This is local scratch space independent of Sink, needed even when
+	// Sink doesn't store its data on local disk.
+	PartDir string
+
+	// Logger, if non-nil, receives diagnostic messages, such as which
+	// index page URL is being fetched.
+	Logger *log.Logger
+
+	// Progress, if non-nil, receives byte-level transfer progress, for
+	// callers that want to render a live display. It's a separate,
+	// optional channel from the Event stream returned by Sync, since its
+	// granularity (partial bytes of a single report) doesn't fit that
+	// stream's report- and page-level events.
+	Progress Progress
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) parallelism() int {
+	if c.Parallelism > 0 {
+		return c.Parallelism
+	}
+	return DefaultParallelism
+}
+
+func (c *Client) partDir() string {
+	if c.PartDir != "" {
+		return c.PartDir
+	}
+	return "."
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+	}
+}
+
+// Report is one entry on an index page: a single report available for
+// download.
+type Report struct {
+	DownloadURL string `json:"download_url"`
+	Index       uint   `json:"index"`
+	// SHA256 is not always present; older reports may not carry a digest.
+	SHA256 string `json:"sha256,omitempty"`
+	// `json:"probe_asn"`
+	// `json:"probe_cc"`
+	// `json:"test_start_time"`
+}
+
+// Progress receives byte-level transfer progress from a Client's download
+// workers. All methods are called concurrently from multiple goroutines,
+// identified by worker, a number in [0, Parallelism).
+type Progress interface {
+	// SetTotal updates the total number of reports matching the query,
+	// once it's known from an index page's metadata.
+	SetTotal(total uint)
+	// Start announces that worker has begun transferring name. total is
+	// the content length in bytes, or 0 if the server didn't send one.
+	Start(worker int, name string, total int64)
+	// Advance adds n bytes to worker's current transfer.
+	Advance(worker int, n int64)
+}
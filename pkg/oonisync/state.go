@@ -0,0 +1,102 @@
+package oonisync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// syncState is the on-disk cursor that lets a later Sync call resume paging
+// through the index instead of starting again at offset 0. It is keyed by a
+// hash of the canonicalized query, so running against a different query with
+// the same StateDir doesn't reuse an unrelated cursor.
+type syncState struct {
+	QueryHash string `json:"query_hash"`
+	// Offset is the number of results already seen for this query, i.e.
+	// where to resume paging.
+	Offset uint `json:"offset"`
+	// LastIndex is the highest Report.Index seen so far. Because the
+	// index is paged in test_start_time order rather than index order
+	// (see the comment in fetchIndexPage), a later page can in principle
+	// contain a lower index; LastIndex is used only as a heuristic for
+	// recognizing a page that contains nothing new.
+	LastIndex uint `json:"last_index"`
+	// ETag and LastModified, if present, are from the response to the
+	// last page paged through on the previous run (the one ending at
+	// Offset). They're sent back as conditional request headers with the
+	// next run's first request, for the page starting at Offset, so a run
+	// with nothing new to sync can avoid paging through the index at all.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// stateFilename is the name of the cursor file, relative to StateDir.
+const stateFilename = ".ooni-sync.state"
+
+func stateFilePath(directory string) string {
+	return filepath.Join(directory, stateFilename)
+}
+
+// queryHash returns a stable identifier for query, used to recognize when a
+// saved cursor belongs to a different query than the one being run.
+func queryHash(query url.Values) string {
+	h := sha256.Sum256([]byte(query.Encode()))
+	return hex.EncodeToString(h[:])
+}
+
+// loadState reads the cursor at path. It returns a nil *syncState, without
+// error, if no cursor file exists yet or the one that exists was saved for a
+// different query.
+func loadState(path, hash string) (*syncState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.QueryHash != hash {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// saveState writes state to path, via a temporary file in the same
+// directory followed by a rename, so that a crash or interruption in the
+// middle of a write can't leave behind a corrupt cursor.
+func saveState(path string, state *syncState) (err error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(path), stateFilename+".tmp.")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpfile.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+
+	_, err = tmpfile.Write(data)
+	err2 := tmpfile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, path)
+}
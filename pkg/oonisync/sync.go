@@ -0,0 +1,81 @@
+package oonisync
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/ooni/ooni-sync/xfer"
+)
+
+// Sync pages through the OONI measurements index for query, downloading
+// every report it finds that isn't already present in c.Sink (and that
+// c.Filter, if set, doesn't reject) into c.Sink.
+//
+// It returns a channel of Events describing its progress; the caller should
+// keep receiving from it until it's closed, which happens once the sync is
+// done, ctx is canceled, or an unrecoverable error occurs while paging
+// through the index. Sync's error result is always nil: errors encountered
+// for individual reports are reported as ReportFailed events, and an error
+// encountered while paging through the index (including one reading the
+// cursor file in StateDir) is logged via c.Logger (if set) and otherwise
+// only observable as the returned channel closing early.
+//
+// If c.StateDir is set, the cursor a later Sync call resumes from is only
+// ever advanced past a report once it's been confirmed downloaded or
+// skipped, never merely queued for download; a run interrupted, or that hits
+// a download failure, partway through leaves the cursor before whatever it
+// didn't confirm, so the next run re-examines (but, via Sink.Exists, doesn't
+// re-download) it.
+func (c *Client) Sync(ctx context.Context, query url.Values) (<-chan Event, error) {
+	query = canonicalizeQuery(query)
+	parallelism := c.parallelism()
+
+	manager := xfer.NewManager(parallelism)
+	downloadURLChan := make(chan downloadJob, ooniAPILimit)
+	workerEventChan := make(chan Event)
+	eventChan := make(chan Event)
+
+	tracker := newCursorTracker(c.StateDir != "", stateFilePath(c.StateDir), c.logf)
+
+	indexDone := make(chan struct{})
+	go func() {
+		err := c.processIndex(ctx, query, downloadURLChan, eventChan, stateFilePath(c.StateDir), tracker)
+		if err != nil {
+			c.logf("error paging through index: %s", err)
+		}
+		close(downloadURLChan)
+		close(indexDone)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		worker := i
+		go func() {
+			defer wg.Done()
+			c.downloadFromChan(ctx, manager, c.partDir(), downloadURLChan, workerEventChan, worker)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(workerEventChan)
+	}()
+
+	// Forward every worker event to eventChan (the stream Sync returns)
+	// and, first, to tracker, so it can persist the cursor once every
+	// report a page queued has reached a terminal outcome; see
+	// cursorTracker's doc comment.
+	go func() {
+		for ev := range workerEventChan {
+			tracker.observe(ev)
+			eventChan <- ev
+		}
+		// processIndex also sends to eventChan; on cancellation the
+		// workers can finish before it does.
+		<-indexDone
+		close(eventChan)
+	}()
+
+	return eventChan, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cheggaaa/pb/v3"
+	"golang.org/x/term"
+
+	"github.com/ooni/ooni-sync/pkg/oonisync"
+)
+
+// reporter is how the program communicates progress to the user, whether
+// that's today's one-line-per-file log or the -progress multi-bar display.
+// It implements oonisync.Progress for byte-level transfer progress, plus a
+// few methods the main loop calls as it consumes the oonisync.Event stream.
+// Its methods are called concurrently from every worker goroutine and must
+// be safe for that.
+type reporter interface {
+	oonisync.Progress
+	// downloaded, skipped, and errored record the outcome of one report
+	// and advance the aggregate count, mirroring the plain-line log
+	// functions they replace.
+	downloaded(worker int, name string)
+	skipped(worker int, name, reason string)
+	errored(worker int, downloadURL string, err error)
+	// stop tears down the reporter once all reports have been processed.
+	stop()
+}
+
+// newReporter returns a bar-based reporter if useProgress is set and stdout
+// is a terminal, or today's plain-line reporter otherwise, so that piping
+// ooni-sync's output to a file or another program is unaffected by
+// -progress.
+func newReporter(useProgress bool, numWorkers int, total uint) reporter {
+	if useProgress && term.IsTerminal(int(os.Stdout.Fd())) {
+		return newBarReporter(numWorkers, total)
+	}
+	return &lineReporter{}
+}
+
+// lineReporter is today's one-line-per-file output.
+type lineReporter struct{}
+
+func (*lineReporter) SetTotal(total uint)                        {}
+func (*lineReporter) Start(worker int, name string, total int64) {}
+func (*lineReporter) Advance(worker int, n int64)                {}
+
+func (*lineReporter) downloaded(worker int, name string) {
+	logOK(name)
+}
+
+func (*lineReporter) skipped(worker int, name, reason string) {
+	if reason == "filtered" {
+		logFiltered(name)
+	} else {
+		logExists(name)
+	}
+}
+
+func (*lineReporter) errored(worker int, downloadURL string, err error) {
+	logError(downloadURL, err)
+}
+
+func (*lineReporter) stop() {}
+
+// barReporter renders one pb progress bar per worker, showing the worker's
+// current filename, bytes transferred, and speed, plus an aggregate bar
+// tracking reports finished out of the total reported by the index page's
+// metadata.
+type barReporter struct {
+	pool      *pb.Pool
+	bars      []*pb.ProgressBar
+	aggregate *pb.ProgressBar
+}
+
+func newBarReporter(numWorkers int, total uint) *barReporter {
+	r := &barReporter{
+		bars: make([]*pb.ProgressBar, numWorkers),
+	}
+	tmpl := `{{ string . "filename" | rndcolor }} {{ counters . }} {{ speed . }}`
+	for i := range r.bars {
+		bar := pb.ProgressBarTemplate(tmpl).New(0)
+		bar.Set("filename", "(idle)")
+		r.bars[i] = bar
+	}
+	r.aggregate = pb.Full.New(int(total))
+	r.aggregate.Set(pb.Bytes, false)
+
+	bars := append(append([]*pb.ProgressBar{}, r.bars...), r.aggregate)
+	r.pool, _ = pb.StartPool(bars...)
+	return r
+}
+
+func (r *barReporter) SetTotal(total uint) {
+	r.aggregate.SetTotal(int64(total))
+}
+
+func (r *barReporter) Start(worker int, name string, total int64) {
+	bar := r.bars[worker]
+	bar.SetCurrent(0)
+	bar.SetTotal(total)
+	bar.Set("filename", name)
+}
+
+func (r *barReporter) Advance(worker int, n int64) {
+	r.bars[worker].Add64(n)
+}
+
+func (r *barReporter) finishFile(worker int) {
+	bar := r.bars[worker]
+	bar.Set("filename", "(idle)")
+	bar.SetCurrent(0)
+	bar.SetTotal(0)
+	r.aggregate.Increment()
+}
+
+func (r *barReporter) downloaded(worker int, name string) {
+	r.finishFile(worker)
+}
+
+func (r *barReporter) skipped(worker int, name, reason string) {
+	if worker == oonisync.NoWorker {
+		// This skip didn't come from any download worker (it's a
+		// report rejected by Client.Filter while paging through the
+		// index), so there's no per-worker bar to reset; just count
+		// it toward the aggregate.
+		r.aggregate.Increment()
+		return
+	}
+	r.finishFile(worker)
+}
+
+func (r *barReporter) errored(worker int, downloadURL string, err error) {
+	r.finishFile(worker)
+	fmt.Fprintf(os.Stderr, "error: %s: %s\n", downloadURL, err)
+}
+
+func (r *barReporter) stop() {
+	r.pool.Stop()
+}
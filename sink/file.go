@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileSink stores reports as files in a local directory, optionally
+// compressing them with one of "xz", "gzip", or "zstd" (see newFilter).
+// Writes are committed atomically, the same way the program always has:
+// Open writes to a temporary file in Directory, and Close renames it into
+// place only once the write (and, if any, compression) has succeeded.
+type FileSink struct {
+	Directory string
+	Compress  string
+}
+
+func (s *FileSink) finalName(name string) string {
+	return filepath.Join(s.Directory, name) + filterExtension(s.Compress)
+}
+
+// Exists implements Sink.
+func (s *FileSink) Exists(name string) (bool, error) {
+	_, err := os.Stat(s.finalName(name))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Open implements Sink.
+func (s *FileSink) Open(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(s.Directory, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(s.Directory, "ooni-sync.tmp.")
+	if err != nil {
+		return nil, err
+	}
+	w, err := newFilter(s.Compress, tmp)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &fileSinkWriter{w: w, tmpName: tmp.Name(), finalName: s.finalName(name)}, nil
+}
+
+type fileSinkWriter struct {
+	w         io.WriteCloser
+	tmpName   string
+	finalName string
+}
+
+func (w *fileSinkWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *fileSinkWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		os.Remove(w.tmpName)
+		return err
+	}
+	return os.Rename(w.tmpName, w.finalName)
+}
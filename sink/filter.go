@@ -0,0 +1,115 @@
+package sink
+
+import (
+	"compress/gzip"
+	"io"
+	"os/exec"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// filterExtension returns the filename suffix conventionally used for the
+// named compression method, or "" for "" (store verbatim) or any other
+// unrecognized value.
+func filterExtension(compress string) string {
+	switch compress {
+	case "xz":
+		return ".xz"
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// newFilter wraps w so that bytes written to the returned io.WriteCloser are
+// compressed with the named method before reaching w, and w itself is
+// closed along with the compressor. compress == "" returns w unchanged.
+func newFilter(compress string, w io.WriteCloser) (io.WriteCloser, error) {
+	switch compress {
+	case "xz":
+		return newXZFilter(w)
+	case "gzip":
+		return &gzipFilter{gz: gzip.NewWriter(w), w: w}, nil
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &zstdFilter{zw: zw, w: w}, nil
+	default:
+		return w, nil
+	}
+}
+
+// xzFilter shells out to the xz(1) binary, as the program did before native
+// gzip and zstd support existed.
+type xzFilter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	w     io.WriteCloser
+}
+
+func newXZFilter(w io.WriteCloser) (io.WriteCloser, error) {
+	var err error
+	xz := &xzFilter{w: w}
+
+	xz.cmd = exec.Command("xz", "-c")
+	xz.cmd.Stdout = w
+	xz.stdin, err = xz.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := xz.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return xz, nil
+}
+
+func (xz *xzFilter) Write(p []byte) (int, error) {
+	return xz.stdin.Write(p)
+}
+
+func (xz *xzFilter) Close() error {
+	if err := xz.stdin.Close(); err != nil {
+		return err
+	}
+	if err := xz.cmd.Wait(); err != nil {
+		return err
+	}
+	return xz.w.Close()
+}
+
+type gzipFilter struct {
+	gz *gzip.Writer
+	w  io.WriteCloser
+}
+
+func (f *gzipFilter) Write(p []byte) (int, error) {
+	return f.gz.Write(p)
+}
+
+func (f *gzipFilter) Close() error {
+	if err := f.gz.Close(); err != nil {
+		return err
+	}
+	return f.w.Close()
+}
+
+type zstdFilter struct {
+	zw *zstd.Encoder
+	w  io.WriteCloser
+}
+
+func (f *zstdFilter) Write(p []byte) (int, error) {
+	return f.zw.Write(p)
+}
+
+func (f *zstdFilter) Close() error {
+	if err := f.zw.Close(); err != nil {
+		return err
+	}
+	return f.w.Close()
+}
@@ -0,0 +1,104 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Sink stores reports as objects in an S3-compatible bucket, under an
+// optional key prefix. Uploads are streamed directly to the bucket via a
+// multipart upload rather than staged on local disk first.
+type S3Sink struct {
+	Bucket   string
+	Prefix   string
+	Client   *s3.Client
+	Uploader *manager.Uploader
+}
+
+// NewS3Sink builds an S3Sink for bucket, storing objects under prefix.
+// Credentials and region are resolved the usual AWS SDK way (environment,
+// shared config, EC2/ECS instance role, and so on).
+func NewS3Sink(ctx context.Context, bucket, prefix string) (*S3Sink, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg)
+	return &S3Sink{
+		Bucket:   bucket,
+		Prefix:   prefix,
+		Client:   client,
+		Uploader: manager.NewUploader(client),
+	}, nil
+}
+
+func (s *S3Sink) key(name string) string {
+	if s.Prefix == "" {
+		return name
+	}
+	return path.Join(s.Prefix, name)
+}
+
+// Exists implements Sink.
+func (s *S3Sink) Exists(name string) (bool, error) {
+	_, err := s.Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err == nil {
+		return true, nil
+	}
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Open implements Sink. The returned writer streams its content to the
+// bucket as a multipart upload, via an in-memory pipe: nothing written to it
+// touches local disk.
+func (s *S3Sink) Open(name string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	w := &s3SinkWriter{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		_, err := s.Uploader.Upload(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.key(name)),
+			Body:   pr,
+		})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+type s3SinkWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3SinkWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3SinkWriter) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
@@ -0,0 +1,60 @@
+// Package sink provides pluggable destinations for downloaded report bytes:
+// plain or compressed files on local disk, a rolling local tar archive, or
+// objects in an S3-compatible bucket.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Sink is a destination that stores named byte streams, replacing the
+// program's original hardcoded use of files on local disk plus an xz
+// subprocess.
+type Sink interface {
+	// Open returns a writer for the report named name (a bare report
+	// filename, with no directory components). Whatever is written to
+	// it, followed by Close, is what a later Exists(name) and, if
+	// applicable, reading it back, will see. Implementations that
+	// compress or otherwise transform the content are responsible for
+	// choosing whatever on-disk or remote name they need; name is just a
+	// stable identifier, not necessarily the literal storage key.
+	Open(name string) (io.WriteCloser, error)
+	// Exists reports whether name was already fully written (Open
+	// followed by a successful Close) in a previous call.
+	Exists(name string) (bool, error)
+}
+
+// Parse builds a Sink from a spec string of the form:
+//
+//	file://DIRECTORY[?compress=xz|gzip|zstd]
+//	tar://DIRECTORY[?compress=zstd]
+//	s3://BUCKET[/PREFIX]
+//
+// It's meant to be used as the argument of the -output flag.
+func Parse(spec string) (Sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parsing -output %q: %w", spec, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &FileSink{
+			Directory: u.Host + u.Path,
+			Compress:  u.Query().Get("compress"),
+		}, nil
+	case "tar":
+		return &TarSink{
+			Directory: u.Host + u.Path,
+			Compress:  u.Query().Get("compress"),
+		}, nil
+	case "s3":
+		return NewS3Sink(context.Background(), u.Host, strings.TrimPrefix(u.Path, "/"))
+	default:
+		return nil, fmt.Errorf("-output %q: unrecognized scheme %q", spec, u.Scheme)
+	}
+}
@@ -0,0 +1,269 @@
+package sink
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// TarSink stores reports as entries in a local tar archive, rotating to a
+// new archive every month (named Directory/reports-YYYY-MM.tar, or
+// .tar.zst if Compress is "zstd") so that any one archive file stays a
+// manageable size.
+//
+// Plain (uncompressed) archives are appended to in place across separate
+// runs of the program, by trimming the two zero blocks that mark a tar
+// archive's end and writing new entries from there. A compressed archive's
+// end-of-stream marker can't be trimmed the same way, so with
+// Compress == "zstd" each run that has anything to write to a given month
+// starts a new, separately-numbered archive segment
+// (reports-YYYY-MM.tar.zst, reports-YYYY-MM.2.tar.zst, ...) instead of
+// trying to resume the previous one.
+type TarSink struct {
+	Directory string
+	Compress  string // "" or "zstd"
+
+	mu    sync.Mutex
+	names map[string]bool // lazily populated by Exists from existing archives
+
+	month   string // YYYY-MM of the currently-open archive, or "" if none
+	archive *os.File
+	zw      *zstd.Encoder // non-nil only if Compress == "zstd"
+	tw      *tar.Writer
+}
+
+// Exists implements Sink.
+func (s *TarSink) Exists(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.names == nil {
+		names, err := s.indexExistingArchives()
+		if err != nil {
+			return false, err
+		}
+		s.names = names
+	}
+	return s.names[name], nil
+}
+
+// indexExistingArchives reads the headers (not the bodies) of every archive
+// segment already in Directory, to learn which report names they contain.
+func (s *TarSink) indexExistingArchives() (map[string]bool, error) {
+	names := map[string]bool{}
+	matches, err := filepath.Glob(filepath.Join(s.Directory, "reports-*.tar*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		if err := indexTarNames(path, names); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+func indexTarNames(path string, names map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if filepath.Ext(path) == ".zst" {
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		names[hdr.Name] = true
+	}
+}
+
+// Open implements Sink.
+func (s *TarSink) Open(name string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.rollIfNeeded(); err != nil {
+		return nil, err
+	}
+	return &tarSinkWriter{sink: s, name: name}, nil
+}
+
+// rollIfNeeded closes the currently-open archive, if any, and opens the one
+// for the current month, if it isn't already open. Callers must hold s.mu.
+func (s *TarSink) rollIfNeeded() error {
+	month := time.Now().Format("2006-01")
+	if s.month == month {
+		return nil
+	}
+	if err := s.closeArchiveLocked(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.Directory, 0755); err != nil {
+		return err
+	}
+	path, archive, err := openArchiveForMonth(s.Directory, month, s.Compress)
+	if err != nil {
+		return err
+	}
+
+	var zw *zstd.Encoder
+	var tw *tar.Writer
+	if s.Compress == "zstd" {
+		zw, err = zstd.NewWriter(archive)
+		if err != nil {
+			archive.Close()
+			return err
+		}
+		tw = tar.NewWriter(zw)
+	} else {
+		tw = tar.NewWriter(archive)
+	}
+
+	s.month = month
+	s.archive = archive
+	s.zw = zw
+	s.tw = tw
+	_ = path
+	return nil
+}
+
+// openArchiveForMonth opens (creating if necessary) the archive segment to
+// write into for month. For uncompressed archives this reopens and trims
+// reports-YYYY-MM.tar so writing can resume where a previous run left off;
+// for zstd archives, which can't be trimmed that way, it finds the next
+// unused numbered segment.
+func openArchiveForMonth(directory, month, compress string) (string, *os.File, error) {
+	ext := ".tar" + filterExtension(compress)
+	if compress == "" {
+		path := filepath.Join(directory, fmt.Sprintf("reports-%s%s", month, ext))
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := trimTarTrailer(f); err != nil {
+			f.Close()
+			return "", nil, err
+		}
+		return path, f, nil
+	}
+
+	for n := 1; ; n++ {
+		var path string
+		if n == 1 {
+			path = filepath.Join(directory, fmt.Sprintf("reports-%s%s", month, ext))
+		} else {
+			path = filepath.Join(directory, fmt.Sprintf("reports-%s.%d%s", month, n, ext))
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return path, f, nil
+	}
+}
+
+// A tar archive ends with (at least) two 512-byte zero blocks. trimTarTrailer
+// removes them, if present, and seeks to the resulting end of file, so that
+// more entries can be appended after the last real one.
+func trimTarTrailer(f *os.File) error {
+	const blockSize = 512
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size >= 2*blockSize {
+		if err := f.Truncate(size - 2*blockSize); err != nil {
+			return err
+		}
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (s *TarSink) closeArchiveLocked() error {
+	if s.tw == nil {
+		return nil
+	}
+	err := s.tw.Close()
+	if s.zw != nil {
+		if err2 := s.zw.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := s.archive.Close(); err == nil {
+		err = err2
+	}
+	s.month, s.archive, s.zw, s.tw = "", nil, nil, nil
+	return err
+}
+
+// Close finalizes and closes whichever archive segment is currently open.
+// TarSink isn't part of the Sink interface's contract, but callers that know
+// they're using a TarSink (or any Sink implementing io.Closer) should call
+// this once they're done downloading, to flush the last archive segment.
+func (s *TarSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeArchiveLocked()
+}
+
+// tarSinkWriter buffers one report's content so its size is known up front,
+// as required by tar.Header.Size, then writes it as a single tar entry on
+// Close.
+type tarSinkWriter struct {
+	sink *TarSink
+	name string
+	buf  []byte
+}
+
+func (w *tarSinkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *tarSinkWriter) Close() error {
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+
+	if err := w.sink.tw.WriteHeader(&tar.Header{
+		Name:    w.name,
+		Mode:    0644,
+		Size:    int64(len(w.buf)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := w.sink.tw.Write(w.buf); err != nil {
+		return err
+	}
+	if w.sink.names != nil {
+		w.sink.names[w.name] = true
+	}
+	return nil
+}
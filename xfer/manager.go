@@ -0,0 +1,220 @@
+// Package xfer implements a small transfer manager for running many
+// retryable, cancellable operations (typically HTTP downloads) with a bound
+// on how many run concurrently. It is modeled loosely on the transfer
+// manager in Docker's distribution code: callers identify a transfer by a
+// key (e.g. a URL), and concurrent requests for the same key share a single
+// underlying attempt rather than duplicating the work.
+package xfer
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Default retry parameters. These add up to at most 3.75 seconds of sleeping
+// across all attempts (250ms + 500ms + 1s + 2s, not counting any delay a
+// server asks for via RetryAfter), which is small compared to the time it takes
+// to fetch a 100+ MB report, but enough to ride out a transient network
+// blip or a brief server hiccup.
+const (
+	initialBackoff = 250 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+	maxAttempts    = 5
+)
+
+// A PermanentError wraps an error that should not be retried, such as an
+// HTTP 404. Do funcs should return a *PermanentError to stop the manager
+// from retrying a transfer that cannot possibly succeed.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so that Manager.Do will not retry it.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// A RetryAfterError wraps a transient error together with a server-specified
+// delay (e.g. from a 429 response's Retry-After header) to wait before
+// retrying, in place of Manager.Do's usual jittered exponential backoff.
+type RetryAfterError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e *RetryAfterError) Error() string { return e.Err.Error() }
+func (e *RetryAfterError) Unwrap() error { return e.Err }
+
+// RetryAfter wraps err with delay so that Manager.Do waits delay before
+// retrying instead of computing its own backoff, for transient errors that
+// come with a server-specified retry delay.
+func RetryAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryAfterError{Err: err, Delay: delay}
+}
+
+// transfer represents one in-flight or completed attempt at transferring the
+// content identified by a key. Multiple calls to Manager.Do with the same
+// key share the same transfer and its result.
+type transfer struct {
+	done chan struct{}
+	err  error
+}
+
+// Manager runs retryable, cancellable operations with a bound on
+// concurrency and deduplication of concurrent requests for the same key.
+type Manager struct {
+	sem chan struct{}
+
+	mu        sync.Mutex
+	transfers map[string]*transfer
+}
+
+// NewManager returns a Manager that runs at most parallelism transfers at
+// once. A parallelism of zero or less is treated as 1.
+func NewManager(parallelism int) *Manager {
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	return &Manager{
+		sem:       make(chan struct{}, parallelism),
+		transfers: make(map[string]*transfer),
+	}
+}
+
+// Do runs fn under the manager's concurrency limit, retrying it with
+// exponential backoff if it returns a non-permanent error, up to a fixed
+// number of attempts. If another call to Do with the same key is already
+// running, Do waits for it and returns its result instead of running fn
+// again.
+//
+// fn should return a *PermanentError (see Permanent) for errors that are
+// certain not to succeed on retry, such as an HTTP 404. Any other error is
+// treated as transient.
+//
+// Do respects ctx: it returns ctx.Err() promptly if ctx is canceled while
+// waiting for a concurrency slot, for another transfer with the same key, or
+// between retry attempts.
+func (m *Manager) Do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	m.mu.Lock()
+	if t, ok := m.transfers[key]; ok {
+		m.mu.Unlock()
+		return waitFor(ctx, t)
+	}
+	t := &transfer{done: make(chan struct{})}
+	m.transfers[key] = t
+	m.mu.Unlock()
+
+	t.err = m.run(ctx, fn)
+	close(t.done)
+
+	m.mu.Lock()
+	delete(m.transfers, key)
+	m.mu.Unlock()
+
+	return t.err
+}
+
+func waitFor(ctx context.Context, t *transfer) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run acquires a concurrency slot and calls fn, retrying with jittered
+// exponential backoff on transient errors.
+func (m *Manager) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	select {
+	case m.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-m.sem }()
+
+	backoff := initialBackoff
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = fn(ctx)
+		if err == nil {
+			return nil
+		}
+		var perm *PermanentError
+		if ok := asPermanentError(err, &perm); ok {
+			return perm.Err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		var retryAfter *RetryAfterError
+		if asRetryAfterError(err, &retryAfter) {
+			// Honor the server's requested delay instead of our
+			// own backoff, and don't let it affect backoff for
+			// any subsequent, non-RetryAfter errors.
+			sleep = retryAfter.Delay
+		}
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if retryAfter == nil {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+	return err
+}
+
+// asPermanentError reports whether err is (or wraps) a *PermanentError, and
+// if so stores it in *target.
+func asPermanentError(err error, target **PermanentError) bool {
+	for err != nil {
+		if perm, ok := err.(*PermanentError); ok {
+			*target = perm
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}
+
+// asRetryAfterError reports whether err is (or wraps) a *RetryAfterError,
+// and if so stores it in *target.
+func asRetryAfterError(err error, target **RetryAfterError) bool {
+	for err != nil {
+		if ra, ok := err.(*RetryAfterError); ok {
+			*target = ra
+			return true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+	return false
+}